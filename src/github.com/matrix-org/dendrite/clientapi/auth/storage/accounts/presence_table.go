@@ -0,0 +1,105 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+CREATE TABLE IF NOT EXISTS account_presence (
+	localpart TEXT NOT NULL PRIMARY KEY,
+	presence TEXT NOT NULL,
+	status_msg TEXT NOT NULL DEFAULT ''
+);
+`
+
+const upsertPresenceSQL = `
+INSERT INTO account_presence (localpart, presence, status_msg) VALUES ($1, $2, $3)
+ON CONFLICT (localpart) DO UPDATE SET presence = $2, status_msg = $3
+`
+
+const selectPresenceSQL = `
+SELECT presence, status_msg FROM account_presence WHERE localpart = $1
+`
+
+// presenceStatements tracks each local user's last-set presence state, so
+// that it can be reported back to other users who share a room with them in
+// the "presence" section of a /sync response.
+type presenceStatements struct {
+	upsertStmt *sql.Stmt
+	selectStmt *sql.Stmt
+}
+
+func (s *presenceStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(presenceSchema); err != nil {
+		return err
+	}
+	if s.upsertStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return err
+	}
+	if s.selectStmt, err = db.Prepare(selectPresenceSQL); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *presenceStatements) upsertPresence(ctx context.Context, localpart, presence, statusMsg string) error {
+	_, err := s.upsertStmt.ExecContext(ctx, localpart, presence, statusMsg)
+	return err
+}
+
+// selectPresenceForUsers looks up the presence of each of the given users
+// (full user IDs) one at a time. Only users local to this server can have an
+// entry here; a userID whose localpart isn't found, or that belongs to
+// another homeserver, is silently skipped.
+func (s *presenceStatements) selectPresenceForUsers(
+	ctx context.Context, userIDs []string,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	events := make([]gomatrixserverlib.ClientEvent, 0, len(userIDs))
+	for _, userID := range userIDs {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+
+		var presence, statusMsg string
+		err = s.selectStmt.QueryRowContext(ctx, localpart).Scan(&presence, &statusMsg)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		content, err := json.Marshal(map[string]interface{}{
+			"presence":   presence,
+			"status_msg": statusMsg,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, gomatrixserverlib.ClientEvent{
+			Type:    "m.presence",
+			Sender:  userID,
+			Content: content,
+		})
+	}
+	return events, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	// Register the postgres driver.
+	_ "github.com/lib/pq"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const profilesSchema = `
+CREATE TABLE IF NOT EXISTS account_profiles (
+	localpart TEXT NOT NULL PRIMARY KEY,
+	display_name TEXT NOT NULL DEFAULT '',
+	avatar_url TEXT NOT NULL DEFAULT ''
+);
+`
+
+const accountDataSchema = `
+CREATE TABLE IF NOT EXISTS account_data (
+	localpart TEXT NOT NULL,
+	room_id TEXT NOT NULL DEFAULT '',
+	type TEXT NOT NULL,
+	content TEXT NOT NULL,
+	PRIMARY KEY (localpart, room_id, type)
+);
+`
+
+// Database stores the data clientapi needs about local users: their
+// profiles, account data and presence.
+type Database struct {
+	db       *sql.DB
+	presence presenceStatements
+}
+
+// NewDatabase opens a postgres connection to the accounts database and
+// prepares its tables and statements.
+func NewDatabase(dataSourceName string) (*Database, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range []string{profilesSchema, accountDataSchema} {
+		if _, err = db.Exec(schema); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Database{db: db}
+	if err = d.presence.prepare(db); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetProfileByLocalpart returns the profile for the given local user, or an
+// empty profile (which is not stored) if they don't have one yet.
+func (d *Database) GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error) {
+	profile := authtypes.Profile{Localpart: localpart}
+	err := d.db.QueryRowContext(ctx,
+		`SELECT display_name, avatar_url FROM account_profiles WHERE localpart = $1`, localpart,
+	).Scan(&profile.DisplayName, &profile.AvatarURL)
+	if err == sql.ErrNoRows {
+		return &profile, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// GetAccountData returns all of localpart's global and per-room account
+// data.
+func (d *Database) GetAccountData(
+	ctx context.Context, localpart string,
+) (global []gomatrixserverlib.ClientEvent, rooms map[string][]gomatrixserverlib.ClientEvent, err error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT room_id, type, content FROM account_data WHERE localpart = $1`, localpart,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	rooms = make(map[string][]gomatrixserverlib.ClientEvent)
+	for rows.Next() {
+		var roomID, dataType, content string
+		if err = rows.Scan(&roomID, &dataType, &content); err != nil {
+			return nil, nil, err
+		}
+		event := gomatrixserverlib.ClientEvent{
+			Type:    dataType,
+			Content: json.RawMessage(content),
+		}
+		if roomID == "" {
+			global = append(global, event)
+		} else {
+			rooms[roomID] = append(rooms[roomID], event)
+		}
+	}
+	return global, rooms, rows.Err()
+}
+
+// GetAccountDataByType returns localpart's account data of the given type,
+// scoped to roomID (the empty string meaning global account data), as a
+// single-element slice, or an empty slice if none is set.
+func (d *Database) GetAccountDataByType(
+	ctx context.Context, localpart, roomID, dataType string,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	var content string
+	err := d.db.QueryRowContext(ctx,
+		`SELECT content FROM account_data WHERE localpart = $1 AND room_id = $2 AND type = $3`,
+		localpart, roomID, dataType,
+	).Scan(&content)
+	if err == sql.ErrNoRows {
+		return []gomatrixserverlib.ClientEvent{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []gomatrixserverlib.ClientEvent{{
+		Type:    dataType,
+		Content: json.RawMessage(content),
+	}}, nil
+}
+
+// SetPresence sets localpart's presence state and status message.
+func (d *Database) SetPresence(ctx context.Context, localpart, presence, statusMsg string) error {
+	return d.presence.upsertPresence(ctx, localpart, presence, statusMsg)
+}
+
+// GetPresencesForUsers returns the current presence of each of the given
+// users as m.presence client events, for users that have ever set a
+// presence state. Users that never have are silently omitted, the same as
+// they would be from the response of an initial /sync.
+func (d *Database) GetPresencesForUsers(ctx context.Context, userIDs []string) ([]gomatrixserverlib.ClientEvent, error) {
+	return d.presence.selectPresenceForUsers(ctx, userIDs)
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+)
+
+// typingEvent mirrors the shape consumed by syncapi/typing's EDU consumer.
+type typingEvent struct {
+	RoomID    string `json:"room_id"`
+	UserID    string `json:"user_id"`
+	Typing    bool   `json:"typing"`
+	TimeoutMS int64  `json:"timeout_ms"`
+}
+
+// TypingServerProducer produces typing EDUs onto Kafka on behalf of local
+// clients, for the syncapi's typing EDU consumer to pick up.
+type TypingServerProducer struct {
+	Producer sarama.SyncProducer
+	Topic    string
+}
+
+// NewTypingServerProducer creates a new TypingServerProducer
+func NewTypingServerProducer(producer sarama.SyncProducer, topic string) *TypingServerProducer {
+	return &TypingServerProducer{Producer: producer, Topic: topic}
+}
+
+// SendTyping sends a m.typing event for userID in roomID, with the given
+// typing state and timeout in milliseconds (ignored when typing is false).
+func (t *TypingServerProducer) SendTyping(roomID, userID string, typing bool, timeoutMS int64) error {
+	ev := typingEvent{
+		RoomID:    roomID,
+		UserID:    userID,
+		Typing:    typing,
+		TimeoutMS: timeoutMS,
+	}
+	value, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: t.Topic,
+		Key:   sarama.StringEncoder(roomID),
+		Value: sarama.ByteEncoder(value),
+	}
+	_, _, err = t.Producer.SendMessage(msg)
+	return err
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type membershipRequest struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Invite implements POST /rooms/{roomID}/invite
+func Invite(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	body, reqErr := parseMembershipRequest(req)
+	if reqErr != nil {
+		return *reqErr
+	}
+
+	_, domain, err := gomatrixserverlib.SplitID('@', body.UserID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid UserID"),
+		}
+	}
+
+	if domain != cfg.Matrix.ServerName {
+		return inviteRemoteUser(req.Context(), req, device, roomID, body.UserID, domain, cfg, query, fedClient, producer)
+	}
+
+	return buildAndSendMembershipEvent(
+		req.Context(), req, device.UserID, body.UserID, roomID, "invite", body.Reason,
+		cfg, query, producer, accountDB, fedClient,
+	)
+}
+
+// Kick implements POST /rooms/{roomID}/kick
+func Kick(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	body, reqErr := parseMembershipRequest(req)
+	if reqErr != nil {
+		return *reqErr
+	}
+
+	return buildAndSendMembershipEvent(
+		req.Context(), req, device.UserID, body.UserID, roomID, "leave", body.Reason,
+		cfg, query, producer, accountDB, fedClient,
+	)
+}
+
+// Ban implements POST /rooms/{roomID}/ban
+func Ban(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	body, reqErr := parseMembershipRequest(req)
+	if reqErr != nil {
+		return *reqErr
+	}
+
+	return buildAndSendMembershipEvent(
+		req.Context(), req, device.UserID, body.UserID, roomID, "ban", body.Reason,
+		cfg, query, producer, accountDB, fedClient,
+	)
+}
+
+// Unban implements POST /rooms/{roomID}/unban
+func Unban(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	body, reqErr := parseMembershipRequest(req)
+	if reqErr != nil {
+		return *reqErr
+	}
+
+	// Unbanning somebody is equivalent to setting their membership back to
+	// "leave", the same as if they had never been in the room.
+	return buildAndSendMembershipEvent(
+		req.Context(), req, device.UserID, body.UserID, roomID, "leave", body.Reason,
+		cfg, query, producer, accountDB, fedClient,
+	)
+}
+
+// Leave implements POST /rooms/{roomID}/leave
+func Leave(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID string,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	return buildAndSendMembershipEvent(
+		req.Context(), req, device.UserID, device.UserID, roomID, "leave", "",
+		cfg, query, producer, accountDB, fedClient,
+	)
+}
+
+func parseMembershipRequest(req *http.Request) (*membershipRequest, *util.JSONResponse) {
+	var body membershipRequest
+	defer req.Body.Close() // nolint: errcheck
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, &util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+			}
+		}
+	}
+	if body.UserID == "" {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("'user_id' must be supplied"),
+		}
+	}
+	return &body, nil
+}
+
+// buildAndSendMembershipEvent builds a m.room.member event setting
+// targetUserID's membership to the given value, populates its content with
+// the target's current displayname/avatar_url, checks auth and sends it to
+// the roomserver.
+func buildAndSendMembershipEvent(
+	ctx context.Context,
+	httpReq *http.Request,
+	senderID, targetUserID, roomID, membership, reason string,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	content := map[string]interface{}{"membership": membership}
+	if reason != "" {
+		content["reason"] = reason
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   senderID,
+		RoomID:   roomID,
+		Type:     "m.room.member",
+		StateKey: &targetUserID,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	event, err := common.BuildEvent(ctx, &builder, cfg, query, &queryRes)
+	if err == common.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = &queryRes.StateEvents[i]
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	// Only now that the sender is known to be authorised to perform this
+	// membership change do we fetch the target's profile, since doing so may
+	// involve firing off a federation request to the target's server.
+	displayName, avatarURL, err := lookupProfile(ctx, targetUserID, cfg, accountDB, fedClient)
+	if err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+	if displayName != "" {
+		content["displayname"] = displayName
+	}
+	if avatarURL != "" {
+		content["avatar_url"] = avatarURL
+	}
+	if err = builder.SetContent(content); err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+	event, err = common.BuildEvent(ctx, &builder, cfg, query, &queryRes)
+	if err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+
+	if err = producer.SendEvents(ctx, []gomatrixserverlib.Event{*event}, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// lookupProfile returns the displayname and avatar URL for userID, fetching
+// them from the local accounts database if userID belongs to this server, or
+// from the remote server's /profile endpoint otherwise. Either field may come
+// back empty if the profile has not set it.
+func lookupProfile(
+	ctx context.Context,
+	userID string,
+	cfg config.Dendrite,
+	accountDB *accounts.Database,
+	fedClient *gomatrixserverlib.FederationClient,
+) (displayName, avatarURL string, err error) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if domain == cfg.Matrix.ServerName {
+		var profile *authtypes.Profile
+		profile, err = accountDB.GetProfileByLocalpart(ctx, localpart)
+		if err != nil {
+			return "", "", err
+		}
+		return profile.DisplayName, profile.AvatarURL, nil
+	}
+
+	resp, err := fedClient.LookupProfile(ctx, domain, userID, "")
+	if err != nil {
+		return "", "", err
+	}
+	return resp.DisplayName, resp.AvatarURL, nil
+}
+
+// inviteRemoteUser builds an invite event for a user on a remote homeserver
+// using our own room state, signs it as this server, and delivers it with
+// send_invite. We do not use make_invite here: that federation endpoint is
+// for the reverse case, where a *remote* server is inviting one of our users
+// and needs us to supply the event template, so calling it against the
+// invitee's own server would ask it to build an event on our behalf that it
+// would then refuse to accept back from us.
+func inviteRemoteUser(
+	ctx context.Context,
+	req *http.Request,
+	device *authtypes.Device,
+	roomID, userID string,
+	remoteServer gomatrixserverlib.ServerName,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	fedClient *gomatrixserverlib.FederationClient,
+	producer *producers.RoomserverProducer,
+) util.JSONResponse {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   device.UserID,
+		RoomID:   roomID,
+		Type:     "m.room.member",
+		StateKey: &userID,
+	}
+	if err := builder.SetContent(map[string]interface{}{"membership": "invite"}); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	event, err := common.BuildEvent(ctx, &builder, cfg, query, &queryRes)
+	if err == common.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = &queryRes.StateEvents[i]
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	respSendInvite, err := fedClient.SendInvite(ctx, remoteServer, *event)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if err = producer.SendEvents(ctx, []gomatrixserverlib.Event{respSendInvite.Event}, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
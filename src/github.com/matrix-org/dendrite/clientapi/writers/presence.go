@@ -0,0 +1,82 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// SetPresence implements PUT /presence/{userID}/status
+func SetPresence(
+	req *http.Request,
+	device *authtypes.Device,
+	userID string,
+	accountDB *accounts.Database,
+) util.JSONResponse {
+	if device.UserID != userID {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Cannot set another user's presence"),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid UserID"),
+		}
+	}
+
+	var body struct {
+		Presence  string `json:"presence"`
+		StatusMsg string `json:"status_msg,omitempty"`
+	}
+	defer req.Body.Close() // nolint: errcheck
+	if err = json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	switch body.Presence {
+	case "online", "offline", "unavailable":
+	default:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("'presence' must be one of online, offline, unavailable"),
+		}
+	}
+
+	if err = accountDB.SetPresence(req.Context(), localpart, body.Presence, body.StatusMsg); err != nil {
+		return util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/util"
+)
+
+// defaultTypingTimeoutMS is used when the client doesn't supply one.
+const defaultTypingTimeoutMS = 30000
+
+// Typing implements PUT /rooms/{roomID}/typing/{userID}
+func Typing(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID, userID string,
+	producer *producers.TypingServerProducer,
+) util.JSONResponse {
+	if device.UserID != userID {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Cannot set another user's typing state"),
+		}
+	}
+
+	var body struct {
+		Typing  bool  `json:"typing"`
+		Timeout int64 `json:"timeout"`
+	}
+	defer req.Body.Close() // nolint: errcheck
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	if body.Typing && body.Timeout <= 0 {
+		body.Timeout = defaultTypingTimeoutMS
+	}
+
+	if err := producer.SendTyping(roomID, userID, body.Typing, body.Timeout); err != nil {
+		return util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type serverACLContent struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals bool     `json:"allow_ip_literals"`
+}
+
+// checkServerACL looks up the current m.room.server_acl state for roomID and
+// returns a 403 M_FORBIDDEN response if origin is denied by it. A nil return
+// means the server is allowed (or the room has no ACL configured).
+func checkServerACL(
+	ctx context.Context, httpReq *http.Request, query api.RoomserverQueryAPI, roomID string, origin gomatrixserverlib.ServerName,
+) *util.JSONResponse {
+	var stateRes api.QueryStateAndAuthChainResponse
+	err := query.QueryStateAndAuthChain(ctx, &api.QueryStateAndAuthChainRequest{
+		RoomID: roomID,
+	}, &stateRes)
+	if err != nil {
+		resp := util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+		return &resp
+	}
+
+	for _, event := range stateRes.StateEvents {
+		if event.Type() != "m.room.server_acl" {
+			continue
+		}
+
+		var acl serverACLContent
+		if err := json.Unmarshal(event.Content(), &acl); err != nil {
+			// A malformed ACL event shouldn't block federation entirely.
+			return nil
+		}
+
+		if isServerACLBanned(acl, origin) {
+			return &util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden("Server " + string(origin) + " is denied by this room's server ACLs"),
+			}
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// isServerACLBanned reports whether serverName is denied by acl: it must not
+// match anything in deny, and (if allow is non-empty) it must match
+// something in allow. IP literal server names are rejected outright unless
+// allow_ip_literals is set.
+func isServerACLBanned(acl serverACLContent, serverName gomatrixserverlib.ServerName) bool {
+	name := string(serverName)
+
+	if !acl.AllowIPLiterals && looksLikeIPLiteral(name) {
+		return true
+	}
+
+	for _, pattern := range acl.Deny {
+		if aclGlobMatches(pattern, name) {
+			return true
+		}
+	}
+
+	if len(acl.Allow) == 0 {
+		return false
+	}
+	for _, pattern := range acl.Allow {
+		if aclGlobMatches(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func looksLikeIPLiteral(name string) bool {
+	host := name
+	if idx := strings.LastIndex(name, ":"); idx != -1 {
+		if matched, err := regexp.MatchString(`^\d+$`, name[idx+1:]); err == nil && matched {
+			host = name[:idx]
+		}
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return regexp.MustCompile(`^[0-9.]+$`).MatchString(host) || strings.Contains(host, ":")
+}
+
+// aclGlobMatches matches name against a server ACL glob pattern, where "*"
+// matches any run of characters and "?" matches exactly one.
+func aclGlobMatches(pattern, name string) bool {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return false
+	}
+	return re.MatchString(name)
+}
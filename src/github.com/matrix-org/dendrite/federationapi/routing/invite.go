@@ -0,0 +1,239 @@
+// Copyright 2017 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// Note: there is no MakeInvite handler here. Unlike make_join, the real
+// federation invite handshake has no "make" half for us to implement: the
+// inviting server is necessarily already a member of the room, so it builds
+// and signs the invite event itself and delivers it directly with
+// send_invite. A GET /make_invite/{roomID}/{userID} that built the event with
+// userID (the invitee, who by definition isn't joined yet) as its own sender
+// could never pass the room's auth checks, and there is no other server
+// identity available at this endpoint to build it with instead. See
+// clientapi/writers/membership.go's inviteRemoteUser for the send_invite-only
+// flow this server actually uses.
+
+// SendInviteV1 implements PUT /_matrix/federation/v1/invite/{roomID}/{eventID}.
+// The response is the legacy [200, event] tuple shape.
+func SendInviteV1(
+	ctx context.Context,
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+	roomID, eventID string,
+) util.JSONResponse {
+	event, jsonErr := signInvite(ctx, httpReq, request, cfg, query, producer, keys, roomID, eventID, request.Content())
+	if jsonErr != nil {
+		return *jsonErr
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: []interface{}{200, event},
+	}
+}
+
+// SendInviteV2 implements PUT /_matrix/federation/v2/invite/{roomID}/{eventID}.
+// The request and response bodies are wrapped in an {"event": ...} envelope
+// rather than being the bare event, per the v2 invite API.
+func SendInviteV2(
+	ctx context.Context,
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+	roomID, eventID string,
+) util.JSONResponse {
+	var body struct {
+		Event           json.RawMessage   `json:"event"`
+		InviteRoomState []json.RawMessage `json:"invite_room_state"`
+		RoomVersion     string            `json:"room_version"`
+	}
+	if err := json.Unmarshal(request.Content(), &body); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	event, jsonErr := signInvite(ctx, httpReq, request, cfg, query, producer, keys, roomID, eventID, body.Event)
+	if jsonErr != nil {
+		return *jsonErr
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{"event": event},
+	}
+}
+
+// signInvite does the work shared by the v1 and v2 invite endpoints: it
+// decodes the invite event, validates it, adds our own server's signature to
+// it (invited users' servers are required to sign invite events they accept
+// on behalf of their user), verifies any third-party invite signature block
+// that may be attached, and hands the event to the roomserver.
+func signInvite(
+	ctx context.Context,
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+	roomID, eventID string,
+	eventJSON []byte,
+) (*gomatrixserverlib.Event, *util.JSONResponse) {
+	if resErr := checkServerACL(ctx, httpReq, query, roomID, request.Origin()); resErr != nil {
+		return nil, resErr
+	}
+
+	var event gomatrixserverlib.Event
+	if err := json.Unmarshal(eventJSON, &event); err != nil {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	if event.RoomID() != roomID {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the invite event JSON"),
+		}
+	}
+	if event.EventID() != eventID {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the invite event JSON"),
+		}
+	}
+	if event.Origin() != request.Origin() {
+		return nil, &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The invite must be sent by the server it originated on"),
+		}
+	}
+
+	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName: event.Origin(),
+		Message:    event.Redact().JSON(),
+		AtTS:       event.OriginServerTS(),
+	}}
+	verifyResults, err := keys.VerifyJSONs(ctx, verifyRequests)
+	if err != nil {
+		resp := httputil.LogThenError(httpReq, err)
+		return nil, &resp
+	}
+	if verifyResults[0].Error != nil {
+		return nil, &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The invite must be signed by the server it originated on"),
+		}
+	}
+
+	if err := verifyThirdPartyInvite(httpReq, keys, event); err != nil {
+		return nil, err
+	}
+
+	signedEvent := event.Sign(
+		string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+	)
+
+	if err := producer.SendEvents(ctx, []gomatrixserverlib.Event{signedEvent}, cfg.Matrix.ServerName); err != nil {
+		resp := httputil.LogThenError(httpReq, err)
+		return nil, &resp
+	}
+
+	return &signedEvent, nil
+}
+
+// verifyThirdPartyInvite checks the signature on the "signed" block of a
+// m.room.third_party_invite completion, if the invite event carries one. If
+// the event has no third_party_invite content, this is a no-op.
+func verifyThirdPartyInvite(httpReq *http.Request, keys gomatrixserverlib.KeyRing, event gomatrixserverlib.Event) *util.JSONResponse {
+	var content struct {
+		ThirdPartyInvite *struct {
+			Signed struct {
+				MXID       string                       `json:"mxid"`
+				Signatures map[string]map[string]string `json:"signatures"`
+				Token      string                       `json:"token"`
+			} `json:"signed"`
+		} `json:"third_party_invite"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The event content could not be parsed: " + err.Error()),
+		}
+	}
+	if content.ThirdPartyInvite == nil {
+		return nil
+	}
+	signed := content.ThirdPartyInvite.Signed
+	if signed.MXID == "" || len(signed.Signatures) == 0 {
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The third_party_invite signed block is missing required fields"),
+		}
+	}
+
+	signedJSON, err := json.Marshal(signed)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	}
+
+	for origin := range signed.Signatures {
+		verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
+			ServerName: gomatrixserverlib.ServerName(origin),
+			Message:    signedJSON,
+			AtTS:       event.OriginServerTS(),
+		}}
+		verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+		if err != nil {
+			resp := httputil.LogThenError(httpReq, err)
+			return &resp
+		}
+		if verifyResults[0].Error != nil {
+			return &util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden("The third_party_invite signed block is not correctly signed"),
+			}
+		}
+	}
+
+	return nil
+}
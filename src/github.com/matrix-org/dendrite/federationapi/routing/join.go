@@ -106,6 +106,10 @@ func SendJoin(
 	keys gomatrixserverlib.KeyRing,
 	roomID, eventID string,
 ) util.JSONResponse {
+	if resErr := checkServerACL(ctx, httpReq, query, roomID, request.Origin()); resErr != nil {
+		return *resErr
+	}
+
 	var event gomatrixserverlib.Event
 	if err := json.Unmarshal(request.Content(), &event); err != nil {
 		return util.JSONResponse{
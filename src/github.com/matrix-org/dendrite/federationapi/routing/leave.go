@@ -0,0 +1,108 @@
+// Copyright 2017 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// SendLeave implements PUT /_matrix/federation/v1/send_leave/{roomID}/{eventID}.
+// Unlike SendJoin, there is no make_leave round trip required here: the
+// leave event is already fully formed by the remote server, so all we do is
+// validate it and forward it into the room.
+func SendLeave(
+	ctx context.Context,
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	now time.Time,
+	keys gomatrixserverlib.KeyRing,
+	roomID, eventID string,
+) util.JSONResponse {
+	if resErr := checkServerACL(ctx, httpReq, query, roomID, request.Origin()); resErr != nil {
+		return *resErr
+	}
+
+	var event gomatrixserverlib.Event
+	if err := json.Unmarshal(request.Content(), &event); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	if event.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the leave event JSON"),
+		}
+	}
+	if event.EventID() != eventID {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the leave event JSON"),
+		}
+	}
+	if event.Origin() != request.Origin() {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The leave must be sent by the server it originated on"),
+		}
+	}
+	if event.Type() != "m.room.member" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The event is not an m.room.member event"),
+		}
+	}
+
+	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName: event.Origin(),
+		Message:    event.Redact().JSON(),
+		AtTS:       event.OriginServerTS(),
+	}}
+	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	if err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+	if verifyResults[0].Error != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The leave must be signed by the server it originated on"),
+		}
+	}
+
+	if err = producer.SendEvents(ctx, []gomatrixserverlib.Event{event}, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(httpReq, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const pathPrefixV1 = "/_matrix/federation/v1"
+const pathPrefixV2 = "/_matrix/federation/v2"
+
+// Setup registers HTTP handlers with the given ServeMux. It also supplies
+// the given RoomserverQueryAPI and RoomserverProducer to the handlers.
+func Setup(
+	apiMux *mux.Router,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+) {
+	v1mux := apiMux.PathPrefix(pathPrefixV1).Subrouter()
+	v2mux := apiMux.PathPrefix(pathPrefixV2).Subrouter()
+
+	v1mux.Handle("/make_join/{roomID}/{eventID}",
+		makeFedAPI(cfg, keys, func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return MakeJoin(
+				httpReq.Context(), httpReq, request, cfg, query, time.Now(), keys,
+				vars["roomID"], vars["eventID"],
+			)
+		}),
+	).Methods(http.MethodGet)
+
+	v1mux.Handle("/send_join/{roomID}/{eventID}",
+		makeFedAPI(cfg, keys, func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return SendJoin(
+				httpReq.Context(), httpReq, request, cfg, query, producer, time.Now(), keys,
+				vars["roomID"], vars["eventID"],
+			)
+		}),
+	).Methods(http.MethodPut)
+
+	v1mux.Handle("/invite/{roomID}/{eventID}",
+		makeFedAPI(cfg, keys, func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return SendInviteV1(
+				httpReq.Context(), httpReq, request, cfg, query, producer, keys,
+				vars["roomID"], vars["eventID"],
+			)
+		}),
+	).Methods(http.MethodPut)
+
+	v2mux.Handle("/invite/{roomID}/{eventID}",
+		makeFedAPI(cfg, keys, func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return SendInviteV2(
+				httpReq.Context(), httpReq, request, cfg, query, producer, keys,
+				vars["roomID"], vars["eventID"],
+			)
+		}),
+	).Methods(http.MethodPut)
+
+	v1mux.Handle("/send_leave/{roomID}/{eventID}",
+		makeFedAPI(cfg, keys, func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return SendLeave(
+				httpReq.Context(), httpReq, request, cfg, query, producer, time.Now(), keys,
+				vars["roomID"], vars["eventID"],
+			)
+		}),
+	).Methods(http.MethodPut)
+
+	v1mux.Handle("/send/{txnID}",
+		makeFedAPI(cfg, keys, func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return Send(
+				httpReq.Context(), httpReq, request, cfg, query, producer,
+			)
+		}),
+	).Methods(http.MethodPut)
+}
+
+// makeFedAPI returns an http.Handler that authenticates an incoming request
+// as coming from the given federation request's origin server before
+// dispatching to f.
+func makeFedAPI(
+	cfg config.Dendrite,
+	keys gomatrixserverlib.KeyRing,
+	f func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse,
+) http.Handler {
+	return util.NewJSONAPI(util.JSONRequestHandler(func(httpReq *http.Request) util.JSONResponse {
+		request, err := gomatrixserverlib.VerifyHTTPRequest(
+			httpReq, time.Now(), string(cfg.Matrix.ServerName), keys,
+		)
+		if err != nil {
+			return httputil.LogThenError(httpReq, err)
+		}
+		vars := mux.Vars(httpReq)
+		return f(httpReq, request, vars)
+	}), util.NewRecoveryHandler())
+}
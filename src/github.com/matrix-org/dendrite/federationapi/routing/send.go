@@ -0,0 +1,89 @@
+// Copyright 2017 New Vector Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// transaction mirrors the body of a federation /send/{txnID} request: a
+// batch of PDUs (room events) and EDUs (ephemeral data units) from the
+// origin server.
+type transaction struct {
+	PDUs []json.RawMessage `json:"pdus"`
+	EDUs []json.RawMessage `json:"edus"`
+}
+
+// Send implements PUT /_matrix/federation/v1/send/{txnID}. Each PDU in the
+// transaction is checked against the target room's m.room.server_acl before
+// being accepted, so a server banned by a room's ACLs cannot push events into
+// that room by including them in a transaction rather than calling send_join
+// or send_leave directly.
+func Send(
+	ctx context.Context,
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+) util.JSONResponse {
+	var txn transaction
+	if err := json.Unmarshal(request.Content(), &txn); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	pduResults := make(map[string]interface{}, len(txn.PDUs))
+	events := make([]gomatrixserverlib.Event, 0, len(txn.PDUs))
+	for _, pduJSON := range txn.PDUs {
+		var event gomatrixserverlib.Event
+		if err := json.Unmarshal(pduJSON, &event); err != nil {
+			continue
+		}
+
+		if resErr := checkServerACL(ctx, httpReq, query, event.RoomID(), request.Origin()); resErr != nil {
+			pduResults[event.EventID()] = map[string]string{
+				"error": "Origin denied by room's server ACLs",
+			}
+			continue
+		}
+
+		events = append(events, event)
+		pduResults[event.EventID()] = map[string]string{}
+	}
+
+	if len(events) > 0 {
+		if err := producer.SendEvents(ctx, events, cfg.Matrix.ServerName); err != nil {
+			return httputil.LogThenError(httpReq, err)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{"pdus": pduResults},
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+const sentMembersSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_sent_members (
+	device_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	PRIMARY KEY (device_id, room_id, user_id)
+);
+`
+
+const selectSentMembersSQL = `
+SELECT user_id FROM syncapi_sent_members WHERE device_id = $1 AND room_id = $2
+`
+
+const insertSentMemberSQL = `
+INSERT INTO syncapi_sent_members (device_id, room_id, user_id) VALUES ($1, $2, $3)
+ON CONFLICT (device_id, room_id, user_id) DO NOTHING
+`
+
+// sentMembersStatements tracks, per device and room, which m.room.member
+// events have already been sent to that device as part of a lazy-loaded
+// sync. Without this a client using lazy_load_members would be sent the same
+// member events on every incremental sync that touched the room, rather than
+// only once per member.
+type sentMembersStatements struct {
+	selectStmt *sql.Stmt
+	insertStmt *sql.Stmt
+}
+
+func (s *sentMembersStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(sentMembersSchema); err != nil {
+		return err
+	}
+	if s.selectStmt, err = db.Prepare(selectSentMembersSQL); err != nil {
+		return err
+	}
+	if s.insertStmt, err = db.Prepare(insertSentMemberSQL); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *sentMembersStatements) selectSentMembers(
+	ctx context.Context, deviceID, roomID string,
+) (map[string]bool, error) {
+	rows, err := s.selectStmt.QueryContext(ctx, deviceID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	sent := make(map[string]bool)
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		sent[userID] = true
+	}
+	return sent, rows.Err()
+}
+
+func (s *sentMembersStatements) insertSentMembers(
+	ctx context.Context, deviceID, roomID string, userIDs []string,
+) error {
+	for _, userID := range userIDs {
+		if _, err := s.insertStmt.ExecContext(ctx, deviceID, roomID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
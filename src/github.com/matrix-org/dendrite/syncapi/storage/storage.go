@@ -0,0 +1,367 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	// Register the postgres driver.
+	_ "github.com/lib/pq"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const outputRoomEventsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
+	id BIGSERIAL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	type TEXT NOT NULL,
+	state_key TEXT,
+	event_json TEXT NOT NULL
+);
+`
+
+const currentRoomStateSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_current_room_state (
+	room_id TEXT NOT NULL,
+	type TEXT NOT NULL,
+	state_key TEXT NOT NULL,
+	event_json TEXT NOT NULL,
+	membership TEXT,
+	PRIMARY KEY (room_id, type, state_key)
+);
+`
+
+const accountDataStreamSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_account_data_stream (
+	id BIGSERIAL PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL DEFAULT '',
+	type TEXT NOT NULL
+);
+`
+
+// SyncServerDatabase stores the room event stream and derived current-state
+// snapshot that the sync API replays to build /sync and /rooms/{roomID}/state
+// responses, along with the bookkeeping tables (sent_members) that let it do
+// so incrementally.
+type SyncServerDatabase struct {
+	db          *sql.DB
+	sentMembers sentMembersStatements
+}
+
+// NewSyncServerDatabase opens a postgres connection to the sync server
+// database and prepares its tables and statements.
+func NewSyncServerDatabase(dataSourceName string) (*SyncServerDatabase, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range []string{outputRoomEventsSchema, currentRoomStateSchema, accountDataStreamSchema} {
+		if _, err = db.Exec(schema); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &SyncServerDatabase{db: db}
+	if err = d.sentMembers.prepare(db); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// CompleteSync returns a /sync response built from scratch: every room the
+// user currently has a membership of "join" in, with up to
+// numRecentEventsPerRoom events of timeline and the room's full current state.
+func (d *SyncServerDatabase) CompleteSync(
+	ctx context.Context, userID string, numRecentEventsPerRoom int,
+) (*types.Response, error) {
+	pos, err := d.maxStreamPosition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := types.NewResponse(pos)
+
+	roomIDs, err := d.joinedRooms(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, roomID := range roomIDs {
+		state, err := d.GetStateEventsForRoom(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		timeline, err := d.recentEvents(ctx, roomID, numRecentEventsPerRoom)
+		if err != nil {
+			return nil, err
+		}
+		res.Rooms.Join[roomID] = types.JoinResponse{
+			State:    types.State{Events: toClientEvents(state)},
+			Timeline: types.Timeline{Events: toClientEvents(timeline)},
+		}
+	}
+
+	return res, nil
+}
+
+// IncrementalSync returns a /sync response containing only the rooms and
+// events that changed between since and currentPos.
+func (d *SyncServerDatabase) IncrementalSync(
+	ctx context.Context, userID string, since, currentPos types.StreamPosition, numRecentEventsPerRoom int,
+) (*types.Response, error) {
+	res := types.NewResponse(currentPos)
+
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT DISTINCT room_id FROM syncapi_output_room_events WHERE id > $1 AND id <= $2`,
+		int64(since), int64(currentPos),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	joined, err := d.joinedRoomSet(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		if !joined[roomID] {
+			continue
+		}
+
+		events, err := d.eventsInRange(ctx, roomID, since, currentPos)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Rooms.Join[roomID] = types.JoinResponse{
+			Timeline: types.Timeline{Events: toClientEvents(events)},
+		}
+	}
+
+	return res, rows.Err()
+}
+
+// GetStateEventsForRoom returns the full current state of roomID.
+func (d *SyncServerDatabase) GetStateEventsForRoom(
+	ctx context.Context, roomID string,
+) ([]gomatrixserverlib.Event, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT event_json FROM syncapi_current_room_state WHERE room_id = $1`, roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var events []gomatrixserverlib.Event
+	for rows.Next() {
+		var eventJSON string
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// GetStateEvent returns the current state event of the given type/state key
+// in roomID, or nil if there isn't one.
+func (d *SyncServerDatabase) GetStateEvent(
+	ctx context.Context, roomID, evType, stateKey string,
+) (*gomatrixserverlib.Event, error) {
+	var eventJSON string
+	err := d.db.QueryRowContext(ctx,
+		`SELECT event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3`,
+		roomID, evType, stateKey,
+	).Scan(&eventJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// GetAccountDataInRange returns, for each room (keyed by room ID, with the
+// empty string meaning global account data) the set of account data types
+// that changed between since and currentPos.
+func (d *SyncServerDatabase) GetAccountDataInRange(
+	ctx context.Context, userID string, since, currentPos types.StreamPosition,
+) (map[string][]string, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT room_id, type FROM syncapi_account_data_stream
+		 WHERE user_id = $1 AND id > $2 AND id <= $3`,
+		userID, int64(since), int64(currentPos),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	result := make(map[string][]string)
+	for rows.Next() {
+		var roomID, dataType string
+		if err = rows.Scan(&roomID, &dataType); err != nil {
+			return nil, err
+		}
+		result[roomID] = append(result[roomID], dataType)
+	}
+	return result, rows.Err()
+}
+
+// GetSentMembers returns the set of user IDs whose m.room.member event has
+// already been sent to deviceID as part of roomID's lazy-loaded state.
+func (d *SyncServerDatabase) GetSentMembers(
+	ctx context.Context, deviceID, roomID string,
+) (map[string]bool, error) {
+	return d.sentMembers.selectSentMembers(ctx, deviceID, roomID)
+}
+
+// MarkMembersSent records that userIDs' m.room.member events have now been
+// sent to deviceID as part of roomID's lazy-loaded state.
+func (d *SyncServerDatabase) MarkMembersSent(
+	ctx context.Context, deviceID, roomID string, userIDs []string,
+) error {
+	return d.sentMembers.insertSentMembers(ctx, deviceID, roomID, userIDs)
+}
+
+func (d *SyncServerDatabase) maxStreamPosition(ctx context.Context) (types.StreamPosition, error) {
+	var pos sql.NullInt64
+	err := d.db.QueryRowContext(ctx, `SELECT MAX(id) FROM syncapi_output_room_events`).Scan(&pos)
+	if err != nil {
+		return 0, err
+	}
+	return types.StreamPosition(pos.Int64), nil
+}
+
+func (d *SyncServerDatabase) joinedRooms(ctx context.Context, userID string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT room_id FROM syncapi_current_room_state
+		 WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join'`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (d *SyncServerDatabase) joinedRoomSet(ctx context.Context, userID string) (map[string]bool, error) {
+	roomIDs, err := d.joinedRooms(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		set[roomID] = true
+	}
+	return set, nil
+}
+
+func (d *SyncServerDatabase) recentEvents(ctx context.Context, roomID string, limit int) ([]gomatrixserverlib.Event, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT event_json FROM syncapi_output_room_events
+		 WHERE room_id = $1 ORDER BY id DESC LIMIT $2`,
+		roomID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var events []gomatrixserverlib.Event
+	for rows.Next() {
+		var eventJSON string
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	// Events come back newest-first; timelines are returned oldest-first.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, rows.Err()
+}
+
+func (d *SyncServerDatabase) eventsInRange(
+	ctx context.Context, roomID string, since, currentPos types.StreamPosition,
+) ([]gomatrixserverlib.Event, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT event_json FROM syncapi_output_room_events
+		 WHERE room_id = $1 AND id > $2 AND id <= $3 ORDER BY id ASC`,
+		roomID, int64(since), int64(currentPos),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var events []gomatrixserverlib.Event
+	for rows.Next() {
+		var eventJSON string
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func toClientEvents(events []gomatrixserverlib.Event) []gomatrixserverlib.ClientEvent {
+	clientEvents := make([]gomatrixserverlib.ClientEvent, len(events))
+	for i, event := range events {
+		clientEvents[i] = gomatrixserverlib.ToClientEvent(event, gomatrixserverlib.FormatAll)
+	}
+	return clientEvents
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const mRoomMember = "m.room.member"
+
+// applyLazyLoading trims the m.room.member state events out of a room's
+// section of a sync response, keeping only the members who authored one of
+// the events in that room's timeline batch. A device's view of "members it
+// has already been sent" is tracked in the sent_members table (keyed by
+// device ID and room ID) so that subsequent incremental syncs don't repeat
+// member events the client already has, unless includeRedundantMembers asks
+// for them anyway.
+func (rp *RequestPool) applyLazyLoading(
+	ctx context.Context, deviceID, roomID string, jr types.JoinResponse, includeRedundantMembers bool,
+) (types.JoinResponse, error) {
+	if len(jr.Timeline.Events) == 0 {
+		return jr, nil
+	}
+
+	senders := make(map[string]bool, len(jr.Timeline.Events))
+	for _, ev := range jr.Timeline.Events {
+		senders[ev.Sender] = true
+	}
+
+	alreadySent, err := rp.db.GetSentMembers(ctx, deviceID, roomID)
+	if err != nil {
+		return jr, err
+	}
+
+	filtered := make([]gomatrixserverlib.ClientEvent, 0, len(jr.State.Events))
+	newlySent := make([]string, 0, len(senders))
+	for _, ev := range jr.State.Events {
+		if ev.Type != mRoomMember {
+			filtered = append(filtered, ev)
+			continue
+		}
+		if ev.StateKey == nil || !senders[*ev.StateKey] {
+			continue
+		}
+		member := *ev.StateKey
+		if !includeRedundantMembers && alreadySent[member] {
+			continue
+		}
+		filtered = append(filtered, ev)
+		newlySent = append(newlySent, member)
+	}
+	jr.State.Events = filtered
+
+	if len(newlySent) > 0 {
+		if err = rp.db.MarkMembersSent(ctx, deviceID, roomID, newlySent); err != nil {
+			return jr, err
+		}
+	}
+
+	return jr, nil
+}
+
+// filterLazyLoadedState applies the same member-trimming as applyLazyLoading
+// to a /rooms/{roomID}/state response. There is no timeline batch to compare
+// senders against here, so the only member event kept unconditionally is the
+// requesting user's own; every other member already sent to this device is
+// dropped, and any not yet sent is recorded as sent.
+func (rp *RequestPool) filterLazyLoadedState(
+	ctx context.Context, deviceID, userID, roomID string, stateEvents []gomatrixserverlib.Event, includeRedundantMembers bool,
+) ([]gomatrixserverlib.Event, error) {
+	alreadySent, err := rp.db.GetSentMembers(ctx, deviceID, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]gomatrixserverlib.Event, 0, len(stateEvents))
+	newlySent := make([]string, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		if ev.Type() != mRoomMember {
+			filtered = append(filtered, ev)
+			continue
+		}
+		stateKey := ev.StateKey()
+		if stateKey == nil {
+			continue
+		}
+		if *stateKey == userID {
+			filtered = append(filtered, ev)
+			continue
+		}
+		if !includeRedundantMembers && alreadySent[*stateKey] {
+			continue
+		}
+		filtered = append(filtered, ev)
+		newlySent = append(newlySent, *stateKey)
+	}
+
+	if len(newlySent) > 0 {
+		if err = rp.db.MarkMembersSent(ctx, deviceID, roomID, newlySent); err != nil {
+			return nil, err
+		}
+	}
+
+	return filtered, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"sync"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// Notifier tracks the current room event stream position and wakes up any
+// blocked /sync requests once a newer position is reached, or once an
+// ephemeral (typing/presence) update happens. Room events have their own
+// position, assigned by the roomserver/DB, that IncrementalSync uses as the
+// bounds of its query range; ephemeral updates don't, so they are tracked by
+// a separate counter of their own rather than folded into currPos, which
+// would otherwise let a burst of them push currPos ahead of the next real
+// room event and cause it to be skipped by OnNewEvent's pos <= currPos
+// guard. Listeners are simply woken on either kind of update and re-check
+// CurrentPosition() (i.e. currPos) themselves.
+type Notifier struct {
+	mu           sync.Mutex
+	currPos      types.StreamPosition
+	ephemeralPos types.StreamPosition
+	listeners    map[*UserStreamListener]struct{}
+}
+
+// NewNotifier makes a new Notifier initialised to the given stream position.
+func NewNotifier(pos types.StreamPosition) *Notifier {
+	return &Notifier{
+		currPos:   pos,
+		listeners: make(map[*UserStreamListener]struct{}),
+	}
+}
+
+// CurrentPosition returns the latest stream position the Notifier knows
+// about.
+func (n *Notifier) CurrentPosition() types.StreamPosition {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.currPos
+}
+
+// OnNewEvent advances the stream position to pos, if it is newer than the
+// current one, and wakes every listener blocked in OnIncomingSyncRequest.
+// Only the room event stream calls this; typing and presence updates go
+// through OnNewEphemeralEvent, which wakes the same listeners without moving
+// this position.
+func (n *Notifier) OnNewEvent(pos types.StreamPosition) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if pos <= n.currPos {
+		return
+	}
+	n.currPos = pos
+	for l := range n.listeners {
+		l.notify()
+	}
+}
+
+// OnNewEphemeralEvent wakes every blocked listener to re-check for new data,
+// the same as OnNewEvent, without touching currPos: ephemeral updates
+// (typing, presence) are recomputed fresh on every sync rather than replayed
+// from a position range, so they have no business advancing the room event
+// position. ephemeralPos only counts these updates; no method reads it. Its
+// no-arg signature makes it
+// directly usable as the typing EDU consumer's OnNewEvent callback.
+func (n *Notifier) OnNewEphemeralEvent() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ephemeralPos++
+	for l := range n.listeners {
+		l.notify()
+	}
+}
+
+// GetListener registers a new listener for req and returns it. The caller
+// MUST call Close on the returned listener once it is done with it.
+func (n *Notifier) GetListener(req syncRequest) *UserStreamListener {
+	l := &UserStreamListener{
+		ch:       make(chan struct{}, 1),
+		notifier: n,
+	}
+	n.mu.Lock()
+	n.listeners[l] = struct{}{}
+	n.mu.Unlock()
+	return l
+}
+
+// UserStreamListener is a handle a blocked /sync request waits on until the
+// Notifier has something new for it.
+type UserStreamListener struct {
+	ch       chan struct{}
+	notifier *Notifier
+}
+
+func (l *UserStreamListener) notify() {
+	select {
+	case l.ch <- struct{}{}:
+	default:
+	}
+}
+
+// GetNotifyChannel returns a channel that will receive a value once the
+// Notifier's position has advanced past currPos, or once an ephemeral update
+// wakes this listener. If the position already has advanced, a pre-fired
+// channel is returned so the caller doesn't block needlessly.
+func (l *UserStreamListener) GetNotifyChannel(currPos types.StreamPosition) <-chan struct{} {
+	if l.notifier.CurrentPosition() > currPos {
+		ch := make(chan struct{}, 1)
+		ch <- struct{}{}
+		return ch
+	}
+	return l.ch
+}
+
+// GetStreamPosition returns the Notifier's current stream position.
+func (l *UserStreamListener) GetStreamPosition() types.StreamPosition {
+	return l.notifier.CurrentPosition()
+}
+
+// Close deregisters this listener from its Notifier.
+func (l *UserStreamListener) Close() {
+	l.notifier.mu.Lock()
+	delete(l.notifier.listeners, l)
+	l.notifier.mu.Unlock()
+}
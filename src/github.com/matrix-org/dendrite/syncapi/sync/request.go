@@ -0,0 +1,131 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// Default number of events per room to return in a /sync response.
+const defaultSyncTimelineLimit = 20
+
+// syncRequest represents a /sync request, with its parameters parsed out of
+// the HTTP request along with a context that is cancelled when either the
+// long-poll timeout elapses or the underlying HTTP request is cancelled,
+// whichever happens first. Passing ctx down into the storage layer lets an
+// in-flight SQL query be cancelled as soon as the client goes away, instead
+// of running to completion for no one.
+type syncRequest struct {
+	ctx                     context.Context
+	userID                  string
+	deviceID                string
+	limit                   int
+	since                   types.StreamPosition
+	timeout                 time.Duration
+	lazyLoadMembers         bool
+	includeRedundantMembers bool
+}
+
+// newSyncRequest parses a /sync request and returns a syncRequest along with
+// a cancel function that the caller MUST call once it is done with the
+// request, to release the resources associated with its context.
+func newSyncRequest(req *http.Request, userID, deviceID string) (*syncRequest, context.CancelFunc, error) {
+	timeout := getTimeout(req)
+	since, err := getSyncStreamPosition(req)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	limit := getLimit(req)
+	lazyLoadMembers, includeRedundantMembers := getLazyLoadFilter(req)
+
+	ctx := req.Context()
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	return &syncRequest{
+		ctx:                     ctx,
+		userID:                  userID,
+		deviceID:                deviceID,
+		limit:                   limit,
+		since:                   since,
+		timeout:                 timeout,
+		lazyLoadMembers:         lazyLoadMembers,
+		includeRedundantMembers: includeRedundantMembers,
+	}, cancel, nil
+}
+
+// getLazyLoadFilter reads the lazy_load_members and include_redundant_members
+// options out of the request's "filter" query parameter. Dendrite does not
+// yet support named/uploaded filters for these options, only the inline
+// filter JSON shape, e.g. filter={"room":{"state":{"lazy_load_members":true}}}.
+func getLazyLoadFilter(req *http.Request) (lazyLoadMembers, includeRedundantMembers bool) {
+	filterJSON := req.URL.Query().Get("filter")
+	if filterJSON == "" {
+		return false, false
+	}
+
+	var filter struct {
+		Room struct {
+			State struct {
+				LazyLoadMembers         bool `json:"lazy_load_members"`
+				IncludeRedundantMembers bool `json:"include_redundant_members"`
+			} `json:"state"`
+		} `json:"room"`
+	}
+	if err := json.Unmarshal([]byte(filterJSON), &filter); err != nil {
+		return false, false
+	}
+	return filter.Room.State.LazyLoadMembers, filter.Room.State.IncludeRedundantMembers
+}
+
+func getTimeout(req *http.Request) time.Duration {
+	timeoutMS, err := strconv.Atoi(req.URL.Query().Get("timeout"))
+	if err != nil || timeoutMS < 0 {
+		return 0
+	}
+	return time.Duration(timeoutMS) * time.Millisecond
+}
+
+func getSyncStreamPosition(req *http.Request) (types.StreamPosition, error) {
+	sinceStr := req.URL.Query().Get("since")
+	if sinceStr == "" {
+		return types.StreamPosition(0), nil
+	}
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil {
+		return types.StreamPosition(0), err
+	}
+	return types.StreamPosition(since), nil
+}
+
+func getLimit(req *http.Request) int {
+	limitStr := req.URL.Query().Get("limit")
+	if limitStr == "" {
+		return defaultSyncTimelineLimit
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return defaultSyncTimelineLimit
+	}
+	return limit
+}
@@ -15,6 +15,7 @@
 package sync
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -25,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/syncapi/typing"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
@@ -32,14 +34,17 @@ import (
 
 // RequestPool manages HTTP long-poll connections for /sync
 type RequestPool struct {
-	db        *storage.SyncServerDatabase
-	accountDB *accounts.Database
-	notifier  *Notifier
+	db          *storage.SyncServerDatabase
+	accountDB   *accounts.Database
+	notifier    *Notifier
+	typingCache *typing.TypingCache
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db *storage.SyncServerDatabase, n *Notifier, adb *accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(
+	db *storage.SyncServerDatabase, n *Notifier, adb *accounts.Database, typingCache *typing.TypingCache,
+) *RequestPool {
+	return &RequestPool{db, adb, n, typingCache}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -49,13 +54,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 	// Extract values from request
 	logger := util.GetLogger(req.Context())
 	userID := device.UserID
-	syncReq, err := newSyncRequest(req, userID)
+	syncReq, cancel, err := newSyncRequest(req, userID, device.ID)
 	if err != nil {
 		return util.JSONResponse{
 			Code: 400,
 			JSON: jsonerror.Unknown(err.Error()),
 		}
 	}
+	defer cancel()
 	logger.WithFields(log.Fields{
 		"userID":  userID,
 		"since":   syncReq.since,
@@ -66,7 +72,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 	// If this is an initial sync or timeout=0 we return immediately
 	if syncReq.since == types.StreamPosition(0) || syncReq.timeout == 0 {
-		syncData, err := rp.currentSyncForUser(*syncReq, currPos)
+		syncData, err := rp.waitForSync(req, *syncReq, currPos)
 		if err != nil {
 			return httputil.LogThenError(req, err)
 		}
@@ -106,7 +112,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 		// of calculating the sync only to get timed out before we
 		// can respond
 
-		syncData, err := rp.currentSyncForUser(*syncReq, currPos)
+		syncData, err := rp.waitForSync(req, *syncReq, currPos)
 		if err != nil {
 			return httputil.LogThenError(req, err)
 		}
@@ -120,6 +126,31 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 	}
 }
 
+// waitForSync runs currentSyncForUser on its own goroutine and waits for
+// either it to finish or for req's context to be done, whichever happens
+// first. Without this, a client that disconnects while we are still
+// building a large sync response would leave us holding open DB connections
+// and doing work for no one; req.Context().Done() lets us give up early.
+func (rp *RequestPool) waitForSync(req *http.Request, syncReq syncRequest, currPos types.StreamPosition) (*types.Response, error) {
+	type result struct {
+		data *types.Response
+		err  error
+	}
+
+	resCh := make(chan result, 1)
+	go func() {
+		data, err := rp.currentSyncForUser(syncReq, currPos)
+		resCh <- result{data, err}
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.data, res.err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
 type stateEventInStateResp struct {
 	gomatrixserverlib.ClientEvent
 	PrevContent   json.RawMessage `json:"prev_content,omitempty"`
@@ -133,7 +164,7 @@ type stateEventInStateResp struct {
 // TODO: Check if the user is in the room. If not, check if the room's history
 // is publicly visible. Current behaviour is returning an empty array if the
 // user cannot see the room's history.
-func (rp *RequestPool) OnIncomingStateRequest(req *http.Request, roomID string) util.JSONResponse {
+func (rp *RequestPool) OnIncomingStateRequest(req *http.Request, device *authtypes.Device, roomID string) util.JSONResponse {
 	// TODO(#287): Auth request and handle the case where the user has left (where
 	// we should return the state at the poin they left)
 
@@ -142,6 +173,14 @@ func (rp *RequestPool) OnIncomingStateRequest(req *http.Request, roomID string)
 		return httputil.LogThenError(req, err)
 	}
 
+	lazyLoadMembers, includeRedundantMembers := getLazyLoadFilter(req)
+	if lazyLoadMembers {
+		stateEvents, err = rp.filterLazyLoadedState(req.Context(), device.ID, device.UserID, roomID, stateEvents, includeRedundantMembers)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+
 	resp := []stateEventInStateResp{}
 	// Fill the prev_content and replaces_state keys if necessary
 	for _, event := range stateEvents {
@@ -222,10 +261,80 @@ func (rp *RequestPool) currentSyncForUser(req syncRequest, currentPos types.Stre
 		return
 	}
 
+	if req.lazyLoadMembers {
+		for roomID, jr := range res.Rooms.Join {
+			jr, err = rp.applyLazyLoading(req.ctx, req.deviceID, roomID, jr, req.includeRedundantMembers)
+			if err != nil {
+				return
+			}
+			res.Rooms.Join[roomID] = jr
+		}
+	}
+
+	err = rp.appendEphemeral(req.ctx, res)
+	if err != nil {
+		return
+	}
+
 	res, err = rp.appendAccountData(res, req.userID, req, currentPos)
 	return
 }
 
+// appendEphemeral fills in the per-room typing notifications and the global
+// presence list. Unlike room events and account data, these aren't streamed
+// incrementally: every /sync response that has anything new to report gets
+// the full current state of who is typing in each returned room, and the
+// presence of every user whose m.room.member state event or timeline events
+// are in the response.
+func (rp *RequestPool) appendEphemeral(ctx context.Context, data *types.Response) error {
+	memberIDs := make(map[string]bool)
+
+	for roomID, jr := range data.Rooms.Join {
+		typingUsers := rp.typingCache.GetTypingUsers(roomID)
+		if len(typingUsers) > 0 {
+			jr.Ephemeral.Events = append(jr.Ephemeral.Events, gomatrixserverlib.ClientEvent{
+				Type:    "m.typing",
+				RoomID:  roomID,
+				Content: typingContent(typingUsers),
+			})
+			data.Rooms.Join[roomID] = jr
+		}
+
+		for _, ev := range jr.State.Events {
+			if ev.Type == mRoomMember && ev.StateKey != nil {
+				memberIDs[*ev.StateKey] = true
+			}
+		}
+		for _, ev := range jr.Timeline.Events {
+			memberIDs[ev.Sender] = true
+		}
+	}
+
+	if len(memberIDs) == 0 {
+		return nil
+	}
+
+	userIDs := make([]string, 0, len(memberIDs))
+	for userID := range memberIDs {
+		userIDs = append(userIDs, userID)
+	}
+
+	presenceEvents, err := rp.accountDB.GetPresencesForUsers(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+	data.Presence.Events = presenceEvents
+	return nil
+}
+
+func typingContent(userIDs []string) json.RawMessage {
+	content, err := json.Marshal(map[string]interface{}{"user_ids": userIDs})
+	if err != nil {
+		return json.RawMessage("{}")
+	}
+	return content
+}
+
 func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
 ) (*types.Response, error) {
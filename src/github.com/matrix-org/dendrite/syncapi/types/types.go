@@ -0,0 +1,133 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// StreamPosition represents the offset into the sync server's stream of
+// room events. It is handed back to clients as part of a sync response's
+// "next_batch" token and echoed back to us as "since" on their next request.
+type StreamPosition int64
+
+// PrevEventRef represents a relationship between a state event and its
+// predecessor. It is stashed in an event's unsigned data by the roomserver
+// so that the sync API can populate "prev_content"/"replaces_state" without
+// a further round-trip.
+type PrevEventRef struct {
+	PrevContent   json.RawMessage `json:"prev_content"`
+	ReplacesState string          `json:"replaces_state"`
+}
+
+// Timeline represents a room's timeline section of a /sync response.
+type Timeline struct {
+	Events    []gomatrixserverlib.ClientEvent `json:"events"`
+	Limited   bool                            `json:"limited"`
+	PrevBatch string                          `json:"prev_batch,omitempty"`
+}
+
+// State represents a room's state section of a /sync response.
+type State struct {
+	Events []gomatrixserverlib.ClientEvent `json:"events"`
+}
+
+// Ephemeral represents a room's ephemeral section of a /sync response (e.g.
+// m.typing).
+type Ephemeral struct {
+	Events []gomatrixserverlib.ClientEvent `json:"events"`
+}
+
+// AccountData represents a room's (or the top-level) account_data section of
+// a /sync response.
+type AccountData struct {
+	Events []gomatrixserverlib.ClientEvent `json:"events"`
+}
+
+// JoinResponse represents a room's entry in the "join" block of a /sync
+// response.
+type JoinResponse struct {
+	Timeline    Timeline    `json:"timeline"`
+	State       State       `json:"state"`
+	Ephemeral   Ephemeral   `json:"ephemeral"`
+	AccountData AccountData `json:"account_data"`
+}
+
+func (jr JoinResponse) isEmpty() bool {
+	return len(jr.Timeline.Events) == 0 && len(jr.State.Events) == 0 &&
+		len(jr.Ephemeral.Events) == 0 && len(jr.AccountData.Events) == 0
+}
+
+// InviteResponse represents a room's entry in the "invite" block of a /sync
+// response.
+type InviteResponse struct {
+	InviteState State `json:"invite_state"`
+}
+
+// LeaveResponse represents a room's entry in the "leave" block of a /sync
+// response.
+type LeaveResponse struct {
+	Timeline Timeline `json:"timeline"`
+	State    State    `json:"state"`
+}
+
+// Rooms represents the "rooms" block of a /sync response.
+type Rooms struct {
+	Join   map[string]JoinResponse   `json:"join,omitempty"`
+	Invite map[string]InviteResponse `json:"invite,omitempty"`
+	Leave  map[string]LeaveResponse  `json:"leave,omitempty"`
+}
+
+// Response represents a complete /sync response.
+type Response struct {
+	NextBatch   string      `json:"next_batch"`
+	AccountData AccountData `json:"account_data,omitempty"`
+	Rooms       Rooms       `json:"rooms"`
+	Presence    Ephemeral   `json:"presence,omitempty"`
+}
+
+// NewResponse creates an empty response with a "next_batch" of since, for
+// returning to a client that long-polled until their request timed out
+// without anything new happening.
+func NewResponse(since StreamPosition) *Response {
+	res := Response{}
+	res.NextBatch = strconv.FormatInt(int64(since), 10)
+	res.Rooms.Join = make(map[string]JoinResponse)
+	res.Rooms.Invite = make(map[string]InviteResponse)
+	res.Rooms.Leave = make(map[string]LeaveResponse)
+	return &res
+}
+
+// IsEmpty returns true if the response has nothing new to tell the client,
+// i.e. there's no point in returning it and we should carry on long-polling
+// instead. Room timeline/state, account data, typing and presence are all
+// things that can make a response non-empty on their own.
+func (r Response) IsEmpty() bool {
+	if len(r.AccountData.Events) > 0 || len(r.Presence.Events) > 0 {
+		return false
+	}
+	if len(r.Rooms.Invite) > 0 || len(r.Rooms.Leave) > 0 {
+		return false
+	}
+	for _, jr := range r.Rooms.Join {
+		if !jr.isEmpty() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package typing
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// event is the shape of the typing EDUs that clientapi's
+// TypingServerProducer produces onto the Kafka topic for local clients.
+type event struct {
+	RoomID    string `json:"room_id"`
+	UserID    string `json:"user_id"`
+	Typing    bool   `json:"typing"`
+	TimeoutMS int64  `json:"timeout_ms"`
+}
+
+// OnNewEvent is the callback signature invoked whenever the cache's state
+// changes, so that callers (the sync Notifier) can wake blocked /sync
+// requests.
+type OnNewEvent func()
+
+// EDUConsumer reads typing EDUs off Kafka and applies them to a TypingCache.
+// Their only producer is clientapi's TypingServerProducer: the federation
+// /send handler does not forward the m.typing EDUs of incoming transactions.
+type EDUConsumer struct {
+	consumer *common.ContinualConsumer
+	cache    *TypingCache
+	onNew    OnNewEvent
+}
+
+// NewEDUConsumer creates a new EDUConsumer. Call Start to begin consuming.
+func NewEDUConsumer(
+	kafkaConsumer sarama.Consumer, topic string, cache *TypingCache, onNew OnNewEvent,
+) *EDUConsumer {
+	c := &EDUConsumer{cache: cache, onNew: onNew}
+	c.consumer = &common.ContinualConsumer{
+		Topic:          topic,
+		Consumer:       kafkaConsumer,
+		PartitionStore: nil,
+		ProcessMessage: c.onMessage,
+	}
+	return c
+}
+
+// Start begins consuming typing EDUs. It returns once the consumer has been
+// set up; message processing continues on its own goroutine.
+func (c *EDUConsumer) Start() error {
+	return c.consumer.Start()
+}
+
+func (c *EDUConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ev event
+	if err := json.Unmarshal(msg.Value, &ev); err != nil {
+		log.WithError(err).Error("typing EDU consumer: failed to unmarshal typing event")
+		return nil
+	}
+
+	if ev.Typing {
+		c.cache.Add(ev.RoomID, ev.UserID, time.Duration(ev.TimeoutMS)*time.Millisecond)
+	} else {
+		c.cache.Remove(ev.RoomID, ev.UserID)
+	}
+
+	if c.onNew != nil {
+		c.onNew()
+	}
+	return nil
+}
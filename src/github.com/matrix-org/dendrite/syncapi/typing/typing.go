@@ -0,0 +1,83 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package typing holds an in-memory cache of which users are currently
+// typing in which rooms, fed by both local clients and remote servers.
+package typing
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultUserExpiry is how long a typing notification is honoured for, if it
+// is not refreshed or explicitly cancelled, when Add is given no positive
+// timeout. It matches the default that PUT /rooms/{roomID}/typing/{userID}
+// applies when the client supplies no timeout.
+const defaultUserExpiry = 30 * time.Second
+
+// TypingCache tracks, per room, which users are currently typing and when
+// each of their typing notifications expires. It is safe for concurrent use.
+type TypingCache struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]time.Time
+}
+
+// NewTypingCache makes a new, empty TypingCache.
+func NewTypingCache() *TypingCache {
+	return &TypingCache{
+		rooms: make(map[string]map[string]time.Time),
+	}
+}
+
+// Add records that userID is typing in roomID until userID calls Remove, or
+// until timeout elapses, whichever comes first.
+func (t *TypingCache) Add(roomID, userID string, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultUserExpiry
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	users, ok := t.rooms[roomID]
+	if !ok {
+		users = make(map[string]time.Time)
+		t.rooms[roomID] = users
+	}
+	users[userID] = time.Now().Add(timeout)
+}
+
+// Remove records that userID has stopped typing in roomID.
+func (t *TypingCache) Remove(roomID, userID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rooms[roomID], userID)
+}
+
+// GetTypingUsers returns the user IDs currently typing in roomID, expiring
+// any whose timeout has passed.
+func (t *TypingCache) GetTypingUsers(roomID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	users := t.rooms[roomID]
+	now := time.Now()
+	typing := make([]string, 0, len(users))
+	for userID, expiresAt := range users {
+		if now.After(expiresAt) {
+			delete(users, userID)
+			continue
+		}
+		typing = append(typing, userID)
+	}
+	return typing
+}